@@ -0,0 +1,658 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ActivityPub (https://www.w3.org/TR/activitypub/) turns every published page into a fediverse actor that Mastodon
+// and friends can follow. Followers are stored per page Name in the "followers" bucket, and each actor's RSA
+// keypair lives in the "actorkeys" bucket, both alongside the existing "pages" bucket in the same Bolt file.
+
+var followersBucket = []byte("followers")
+var actorKeysBucket = []byte("actorkeys")
+
+// signatureMaxClockSkew bounds how stale a signed request's Date header may be before verifyHttpSignature
+// refuses it, closing the window for replaying a captured signed POST.
+var signatureMaxClockSkew = 30 * time.Second
+
+type apActivity struct {
+	Body      []byte // raw outbound JSON body, already built
+	Inbox     string
+	ActorName string // page Name whose key this activity must be signed with
+}
+
+var activityQueue = make(chan apActivity, 100)
+
+var activityQueueDb *bolt.DB
+
+// startActivityQueueWorker kicks off the delivery goroutine once the Bolt db is available. Deliveries need the
+// db to sign requests with the sending actor's key, so this is called from main() right after the db is opened,
+// the same way bootstrapAdmin and migrateLegacyPages are.
+func startActivityQueueWorker(db *bolt.DB) {
+	activityQueueDb = db
+	go activityQueueWorker()
+}
+
+// activityQueueWorker delivers queued activities to follower inboxes, retrying with a simple exponential backoff.
+func activityQueueWorker() {
+	for act := range activityQueue {
+		go deliverWithRetry(act)
+	}
+}
+
+func deliverWithRetry(act apActivity) {
+	backoff := 1 * time.Second
+	for attempt := 0; attempt < 5; attempt++ {
+		if err := postActivity(activityQueueDb, act); err == nil {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	log.Printf("activitypub: giving up delivering to %s\n", act.Inbox)
+}
+
+// postActivity signs the outbound request with the sending actor's RSA key before delivering it. Mastodon and
+// every other major server reject unsigned inbox POSTs, so this is not optional.
+func postActivity(db *bolt.DB, act apActivity) error {
+	key, err := actorKeyPair(db, act.ActorName)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", act.Inbox, bytes.NewReader(act.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+
+	keyId := baseUrl + "/" + act.ActorName + "#main-key"
+	if err := signRequest(req, key, keyId, act.Body); err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("activitypub: inbox %s returned %d", act.Inbox, resp.StatusCode)
+	}
+	return nil
+}
+
+// signRequest adds the `Signature` header (https://tools.ietf.org/html/draft-cavage-http-signatures), the same
+// scheme verifyHttpSignature checks on the way in, covering (request-target), host, date and the body digest.
+func signRequest(req *http.Request, key *rsa.PrivateKey, keyId string, body []byte) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	digest := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+
+	headerNames := []string{"(request-target)", "host", "date", "digest"}
+	lines := []string{
+		fmt.Sprintf("(request-target): post %s", req.URL.RequestURI()),
+		fmt.Sprintf("host: %s", req.URL.Host),
+		fmt.Sprintf("date: %s", req.Header.Get("Date")),
+		fmt.Sprintf("digest: %s", req.Header.Get("Digest")),
+	}
+	signingString := strings.Join(lines, "\n")
+
+	hashed := sha256.Sum256([]byte(signingString))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyId, strings.Join(headerNames, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// actorKeyPair returns the RSA keypair for a page's actor, generating and persisting one on first use.
+func actorKeyPair(db *bolt.DB, name string) (*rsa.PrivateKey, error) {
+	var pemBytes []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(actorKeysBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(name))
+		if v != nil {
+			pemBytes = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if pemBytes != nil {
+		block, _ := pem.Decode(pemBytes)
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	pemBytes = pem.EncodeToMemory(block)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(actorKeysBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), pemBytes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func actorPublicKeyPEM(key *rsa.PrivateKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	block := &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	return string(pem.EncodeToMemory(block))
+}
+
+// buildActor renders the ActivityPub Actor document for a page, including verified-style social links drawn from
+// the same fields already validated in apiPut/apiPost.
+func buildActor(page *Page, key *rsa.PrivateKey) map[string]interface{} {
+	actorUrl := baseUrl + "/" + page.Name
+
+	var attachment []map[string]string
+	addLink := func(name, value, href string) {
+		if value == "" {
+			return
+		}
+		attachment = append(attachment, map[string]string{
+			"type":  "PropertyValue",
+			"name":  name,
+			"value": fmt.Sprintf(`<a href="%s">%s</a>`, href, value),
+		})
+	}
+	addLink("Twitter", page.Twitter, "https://twitter.com/"+page.Twitter)
+	addLink("GitHub", page.GitHub, "https://github.com/"+page.GitHub)
+	addLink("Website", page.Website, page.Website)
+
+	return map[string]interface{}{
+		"@context":          []string{"https://www.w3.org/ns/activitystreams"},
+		"type":              "Person",
+		"id":                actorUrl,
+		"preferredUsername": page.Name,
+		"name":              page.Title,
+		"inbox":             actorUrl + "/inbox",
+		"outbox":            actorUrl + "/outbox",
+		"attachment":        attachment,
+		"publicKey": map[string]string{
+			"id":           actorUrl + "#main-key",
+			"owner":        actorUrl,
+			"publicKeyPem": actorPublicKeyPEM(key),
+		},
+	}
+}
+
+func webfingerHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resource := r.FormValue("resource")
+		name := strings.TrimPrefix(resource, "acct:")
+		name = strings.SplitN(name, "@", 2)[0]
+
+		page, errGet := storeGetPage(db, name)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			http.Error(w, errGet.Error(), http.StatusInternalServerError)
+			return
+		}
+		if page == nil {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jrd+json")
+		json.NewEncoder(w).Encode(struct {
+			Subject string              `json:"subject"`
+			Links   []map[string]string `json:"links"`
+		}{
+			Subject: resource,
+			Links: []map[string]string{
+				{"rel": "self", "type": "application/activity+json", "href": baseUrl + "/" + page.Name},
+			},
+		})
+	}
+}
+
+// wantsActivityJson is true when the client asked for ActivityStreams content, which is how Mastodon fetches an
+// actor document from the same URL a human would view in a browser.
+func wantsActivityJson(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json")
+}
+
+func serveActor(w http.ResponseWriter, db *bolt.DB, page *Page) {
+	key, err := actorKeyPair(db, page.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/activity+json")
+	json.NewEncoder(w).Encode(buildActor(page, key))
+}
+
+func outboxHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/outbox")
+
+		page, errGet := storeGetPage(db, name)
+		if errGet != nil {
+			http.Error(w, errGet.Error(), http.StatusInternalServerError)
+			return
+		}
+		if page == nil {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+
+		actorUrl := baseUrl + "/" + page.Name
+		items := []map[string]interface{}{createActivity(page, actorUrl)}
+
+		w.Header().Set("Content-Type", "application/activity+json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"@context":     "https://www.w3.org/ns/activitystreams",
+			"id":           actorUrl + "/outbox",
+			"type":         "OrderedCollection",
+			"totalItems":   len(items),
+			"orderedItems": items,
+		})
+	}
+}
+
+func createActivity(page *Page, actorUrl string) map[string]interface{} {
+	noteUrl := actorUrl
+	return map[string]interface{}{
+		"@context": "https://www.w3.org/ns/activitystreams",
+		"id":       noteUrl + "#create",
+		"type":     "Create",
+		"actor":    actorUrl,
+		"object": map[string]interface{}{
+			"id":           noteUrl,
+			"type":         "Note",
+			"attributedTo": actorUrl,
+			"content":      string(page.Html),
+			"published":    page.Inserted.Format(time.RFC3339),
+		},
+	}
+}
+
+// inboxHandler accepts Follow/Undo/Delete activities. A valid HTTP Signature is required before the activity is
+// acted upon.
+func inboxHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/inbox")
+
+		if !verifyHttpSignature(r) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var activity struct {
+			Type   string      `json:"type"`
+			Actor  string      `json:"actor"`
+			Object interface{} `json:"object"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&activity); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		switch activity.Type {
+		case "Follow":
+			if err := addFollower(db, name, activity.Actor); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			go sendAcceptFollow(db, name, activity.Actor)
+
+		case "Undo", "Delete":
+			if err := removeFollower(db, name, activity.Actor); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func followerInboxUrl(actor string) (string, error) {
+	resp, err := http.Get(actor)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		Inbox string `json:"inbox"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", err
+	}
+	return doc.Inbox, nil
+}
+
+func sendAcceptFollow(db *bolt.DB, name, follower string) {
+	inbox, err := followerInboxUrl(follower)
+	if err != nil {
+		log.Printf("activitypub: could not resolve inbox for %s: %v\n", follower, err)
+		return
+	}
+
+	actorUrl := baseUrl + "/" + name
+	body, _ := json.Marshal(map[string]interface{}{
+		"@context": "https://www.w3.org/ns/activitystreams",
+		"type":     "Accept",
+		"actor":    actorUrl,
+		"object": map[string]string{
+			"type":  "Follow",
+			"actor": follower,
+		},
+	})
+
+	activityQueue <- apActivity{Body: body, Inbox: inbox, ActorName: name}
+}
+
+func getFollowers(db *bolt.DB, name string) ([]string, error) {
+	var followers []string
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(followersBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &followers)
+	})
+	return followers, err
+}
+
+func addFollower(db *bolt.DB, name, actor string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(followersBucket)
+		if err != nil {
+			return err
+		}
+
+		var followers []string
+		if v := b.Get([]byte(name)); v != nil {
+			json.Unmarshal(v, &followers)
+		}
+		for _, f := range followers {
+			if f == actor {
+				return nil
+			}
+		}
+		followers = append(followers, actor)
+
+		out, err := json.Marshal(followers)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), out)
+	})
+}
+
+func removeFollower(db *bolt.DB, name, actor string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(followersBucket)
+		if err != nil {
+			return err
+		}
+
+		var followers []string
+		if v := b.Get([]byte(name)); v != nil {
+			json.Unmarshal(v, &followers)
+		}
+
+		kept := followers[:0]
+		for _, f := range followers {
+			if f != actor {
+				kept = append(kept, f)
+			}
+		}
+
+		out, err := json.Marshal(kept)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), out)
+	})
+}
+
+// enqueueCreate is called by apiPut/apiPost on success to federate a newly published or updated page out to its
+// followers.
+func enqueueCreate(db *bolt.DB, page Page) {
+	followers, err := getFollowers(db, page.Name)
+	if err != nil {
+		log.Printf("activitypub: could not load followers for %s: %v\n", page.Name, err)
+		return
+	}
+	if len(followers) == 0 {
+		return
+	}
+
+	actorUrl := baseUrl + "/" + page.Name
+	body, err := json.Marshal(createActivity(&page, actorUrl))
+	if err != nil {
+		log.Printf("activitypub: could not marshal activity: %v\n", err)
+		return
+	}
+
+	// followers are stored as actor URLs, so each one's inbox is looked up off its Actor document first
+	for _, follower := range followers {
+		go func(follower string) {
+			inbox, err := followerInboxUrl(follower)
+			if err != nil {
+				log.Printf("activitypub: could not resolve inbox for %s: %v\n", follower, err)
+				return
+			}
+			activityQueue <- apActivity{Body: body, Inbox: inbox, ActorName: page.Name}
+		}(follower)
+	}
+}
+
+// verifyHttpSignature checks the `Signature` request header (https://tools.ietf.org/html/draft-cavage-http-signatures)
+// against the public key published on the signing actor's Actor document. Signing the `digest` header alone only
+// proves the signer vouched for *some* digest value; it does nothing to stop a captured request's body being
+// swapped out afterwards unless the digest is also checked against the bytes that actually arrived, so this also
+// recomputes the body's digest and rejects a stale Date, closing the replay window a header-only check leaves open.
+func verifyHttpSignature(r *http.Request) bool {
+	sigHeader := r.Header.Get("Signature")
+	if sigHeader == "" {
+		return false
+	}
+
+	params := parseSignatureHeader(sigHeader)
+	keyId := params["keyId"]
+	sig := params["signature"]
+	headerNames := strings.Fields(params["headers"])
+	if keyId == "" || sig == "" || len(headerNames) == 0 {
+		return false
+	}
+
+	if !freshDate(r.Header.Get("Date")) {
+		return false
+	}
+
+	if !verifyBodyDigest(r) {
+		return false
+	}
+
+	pubKey, err := fetchActorPublicKey(keyId)
+	if err != nil {
+		log.Printf("activitypub: could not fetch key %s: %v\n", keyId, err)
+		return false
+	}
+
+	var lines []string
+	for _, h := range headerNames {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI()))
+		case "host":
+			// Go strips the Host header out of r.Header and into r.Host, both for requests it builds
+			// (signRequest, above) and ones it parses off the wire, so it has to be special-cased here too.
+			lines = append(lines, fmt.Sprintf("host: %s", r.Host))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %s", h, r.Header.Get(h)))
+		}
+	}
+	signingString := strings.Join(lines, "\n")
+
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(signingString))
+	return rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, digest[:], sigBytes) == nil
+}
+
+// freshDate rejects a missing, malformed or out-of-window Date header, so a signed request captured off the wire
+// can't be replayed indefinitely.
+func freshDate(date string) bool {
+	if date == "" {
+		return false
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(t)
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew <= signatureMaxClockSkew
+}
+
+// verifyBodyDigest reads the request body and checks it against the claimed `Digest` header, then replaces
+// r.Body so inboxHandler can still decode it. Without this, the Signature only authenticates the headers
+// (including the claimed digest value) and never the body those headers claim to describe, so a captured
+// request's body can be swapped out while its signature still verifies.
+func verifyBodyDigest(r *http.Request) bool {
+	claimed := r.Header.Get("Digest")
+	if claimed == "" {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	sum := sha256.Sum256(body)
+	want := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	return claimed == want
+}
+
+func parseSignatureHeader(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.TrimSpace(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+func fetchActorPublicKey(keyId string) (*rsa.PublicKey, error) {
+	actorUrl := strings.SplitN(keyId, "#", 2)[0]
+	if _, err := url.ParseRequestURI(actorUrl); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", actorUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/activity+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		PublicKey struct {
+			PublicKeyPem string `json:"publicKeyPem"`
+		} `json:"publicKey"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(doc.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("activitypub: no PEM block in key for %s", actorUrl)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("activitypub: key for %s is not RSA", actorUrl)
+	}
+	return rsaPub, nil
+}
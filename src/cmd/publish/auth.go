@@ -0,0 +1,535 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User accounts replace the old "anyone who knows the 16-char Id can edit" scheme with real logins, so a person
+// can own and manage more than one page from a single dashboard.
+
+var usersBucket = []byte("users")
+var sessionsBucket = []byte("sessions")
+var invitesBucket = []byte("invites")
+
+var sessionCookieName = "publishli_session"
+var sessionTtl = 30 * 24 * time.Hour
+
+// legacyUserId is the synthetic owner attached to every page that existed before accounts did. Pages can be moved
+// out from under it by entering their original 16-char Id on the claim page.
+var legacyUserId = "legacy"
+
+type User struct {
+	Id           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Email        string    `json:"email"`
+	Admin        bool      `json:"admin"`
+	CanInvite    bool      `json:"canInvite"`
+	Inserted     time.Time `json:"inserted"`
+	Updated      time.Time `json:"updated"`
+}
+
+func storeGetUser(db *bolt.DB, username string) (*User, error) {
+	var user *User
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(username))
+		if v == nil {
+			return nil
+		}
+		user = &User{}
+		return json.Unmarshal(v, user)
+	})
+	return user, err
+}
+
+func storePutUser(db *bolt.DB, user User) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+		out, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(user.Username), out)
+	})
+}
+
+// session maps a random token to a username, so a browser cookie is all a device needs to carry, and looking the
+// user back up is a single keyed `users` bucket Get rather than a scan.
+type session struct {
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+func createSession(db *bolt.DB, username string) (string, error) {
+	token := randStr(32)
+	sess := session{Username: username, Expires: time.Now().Add(sessionTtl)}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		if err != nil {
+			return err
+		}
+		out, err := json.Marshal(sess)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(token), out)
+	})
+	return token, err
+}
+
+func destroySession(db *bolt.DB, token string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(token))
+	})
+}
+
+func currentUser(db *bolt.DB, r *http.Request) (*User, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, nil
+	}
+
+	var sess session
+	found := false
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionsBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(cookie.Value))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &sess)
+	})
+	if err != nil || !found || sess.Expires.Before(time.Now()) {
+		return nil, err
+	}
+
+	return storeGetUser(db, sess.Username)
+}
+
+func setSessionCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionTtl),
+		HttpOnly: true,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    sessionCookieName,
+		Value:   "",
+		Path:    "/",
+		Expires: time.Unix(0, 0),
+	})
+}
+
+// storeGetInvite and storeUseInvite implement the "CanInvite" pattern: an existing user with CanInvite set mints
+// a one-time code, and /signup is gated behind redeeming it.
+type invite struct {
+	IssuedBy string `json:"issuedBy"`
+	Used     bool   `json:"used"`
+}
+
+func storeGetInvite(db *bolt.DB, code string) (*invite, error) {
+	var inv *invite
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(invitesBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(code))
+		if v == nil {
+			return nil
+		}
+		inv = &invite{}
+		return json.Unmarshal(v, inv)
+	})
+	return inv, err
+}
+
+func storeUseInvite(db *bolt.DB, code string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(invitesBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(code))
+		if v == nil {
+			return nil
+		}
+		var inv invite
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return err
+		}
+		inv.Used = true
+		out, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(code), out)
+	})
+}
+
+func storePutInvite(db *bolt.DB, code string, inv invite) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(invitesBucket)
+		if err != nil {
+			return err
+		}
+		out, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(code), out)
+	})
+}
+
+// inviteHandler lets an existing user with CanInvite (admins always can) mint a one-time signup code for
+// someone else. Without this, nothing could ever write to invitesBucket and /signup would reject everyone.
+func inviteHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+
+		user, err := currentUser(db, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user == nil || !(user.Admin || user.CanInvite) {
+			sendError(w, "Permission denied.")
+			return
+		}
+
+		code := randStr(12)
+		if err := storePutInvite(db, code, invite{IssuedBy: user.Id}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Ok      bool              `json:"ok"`
+			Msg     string            `json:"msg"`
+			Payload map[string]string `json:"payload"`
+		}{
+			Ok:      true,
+			Msg:     "Invite created",
+			Payload: map[string]string{"invite": code},
+		}
+		sendJson(w, data)
+	}
+}
+
+// bootstrapAdmin creates the first admin user from ADMIN_USERNAME/ADMIN_PASSWORD if the "users" bucket is still
+// empty, so there's a way to invite anyone in the first place. It is a no-op once any user exists, so it's safe
+// to call unconditionally every time the process starts, right after the Bolt db is opened.
+func bootstrapAdmin(db *bolt.DB) error {
+	empty := true
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			empty = false
+			return nil
+		})
+	})
+	if err != nil || !empty {
+		return err
+	}
+
+	username := os.Getenv("ADMIN_USERNAME")
+	password := os.Getenv("ADMIN_PASSWORD")
+	if username == "" || password == "" {
+		log.Printf("bootstrapAdmin: no users exist yet and ADMIN_USERNAME/ADMIN_PASSWORD are unset, skipping\n")
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	admin := User{
+		Id:           randStr(16),
+		Username:     username,
+		PasswordHash: string(hash),
+		Email:        os.Getenv("ADMIN_EMAIL"),
+		Admin:        true,
+		CanInvite:    true,
+		Inserted:     now,
+		Updated:      now,
+	}
+	return storePutUser(db, admin)
+}
+
+// migrateLegacyPages attaches every pre-accounts page (OwnerId still empty) to the synthetic legacy user, so it
+// shows up as claimable rather than unowned. Like bootstrapAdmin, it's safe to call unconditionally on startup.
+func migrateLegacyPages(db *bolt.DB) error {
+	var names []string
+	err := storeIteratePages(db, func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		page, errGet := storeGetPage(db, name)
+		if errGet != nil {
+			return errGet
+		}
+		if page == nil || page.OwnerId != "" {
+			continue
+		}
+		page.OwnerId = legacyUserId
+		if err := storePutPage(db, *page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func signupHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			render(w, "signup.html", struct{ Layout string }{"signup"})
+			return
+		}
+
+		code := r.FormValue("invite")
+		inv, errGet := storeGetInvite(db, code)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+		if inv == nil || inv.Used {
+			sendError(w, "Invalid or already-used invite code.")
+			return
+		}
+
+		username := r.FormValue("username")
+		password := r.FormValue("password")
+		email := r.FormValue("email")
+		if username == "" || password == "" {
+			sendError(w, "Provide a username and password")
+			return
+		}
+
+		existing, errGet := storeGetUser(db, username)
+		if errGet != nil {
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+		if existing != nil {
+			sendError(w, "That username is already taken.")
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		user := User{
+			Id:           randStr(16),
+			Username:     username,
+			PasswordHash: string(hash),
+			Email:        email,
+			Inserted:     now,
+			Updated:      now,
+		}
+		if err := storePutUser(db, user); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := storeUseInvite(db, code); err != nil {
+			log.Printf("Error: %v\n", err)
+		}
+
+		token, err := createSession(db, user.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, token)
+
+		http.Redirect(w, r, "/me", http.StatusSeeOther)
+	}
+}
+
+func loginHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			render(w, "login.html", struct{ Layout string }{"login"})
+			return
+		}
+
+		username := r.FormValue("username")
+		password := r.FormValue("password")
+
+		user, errGet := storeGetUser(db, username)
+		if errGet != nil {
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+		if user == nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			sendError(w, "Invalid username or password.")
+			return
+		}
+
+		token, err := createSession(db, user.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, token)
+
+		http.Redirect(w, r, "/me", http.StatusSeeOther)
+	}
+}
+
+func logoutHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err == nil {
+			if err := destroySession(db, cookie.Value); err != nil {
+				log.Printf("Error: %v\n", err)
+			}
+		}
+		clearSessionCookie(w)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// claimHandler lets a logged-in user move a legacy-owned (or anonymously-published) page under their own account
+// by proving they hold its original capability Id.
+func claimHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := currentUser(db, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			sendError(w, "Permission denied.")
+			return
+		}
+
+		name := r.FormValue("name")
+		id := r.FormValue("id")
+
+		page, errGet := storeGetPage(db, name)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+		if page == nil || page.Id != id {
+			sendError(w, "This page name and Id don't match.")
+			return
+		}
+		if page.OwnerId != legacyUserId {
+			sendError(w, "This page already belongs to an account.")
+			return
+		}
+
+		page.OwnerId = user.Id
+		if err := storePutPage(db, *page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/me", http.StatusSeeOther)
+	}
+}
+
+// meHandler is the multi-page dashboard: every page owned by the logged-in user, in one place.
+func meHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := currentUser(db, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		var pages []*Page
+		err = storeIteratePages(db, func(k, v []byte) error {
+			page, errGet := storeGetPage(db, string(k))
+			if errGet != nil {
+				return errGet
+			}
+			if page != nil && page.OwnerId == user.Id {
+				pages = append(pages, page)
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Layout string
+			User   *User
+			Pages  []*Page
+		}{"dashboard", user, pages}
+		render(w, "dashboard.html", data)
+	}
+}
@@ -0,0 +1,241 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// feed.go is sitemap's sibling: sitemap lists every page as plain text for crawlers, these list every page (or a
+// subset scoped to one author) as Atom, RSS and JSON Feed for readers and feed aggregators.
+
+// feedPages iterates every page the way sitemap does, then scopes the result to ?author=, ?twitter= or ?github=
+// when given.
+func feedPages(db *bolt.DB, r *http.Request) ([]*Page, error) {
+	author := r.FormValue("author")
+	twitter := r.FormValue("twitter")
+	github := r.FormValue("github")
+
+	var pages []*Page
+	err := storeIteratePages(db, func(k, v []byte) error {
+		page, errGet := storeGetPage(db, string(k))
+		if errGet != nil {
+			return errGet
+		}
+		if page == nil {
+			return nil
+		}
+		if author != "" && page.Author != author {
+			return nil
+		}
+		if twitter != "" && page.Twitter != twitter {
+			return nil
+		}
+		if github != "" && page.GitHub != github {
+			return nil
+		}
+		pages = append(pages, page)
+		return nil
+	})
+	return pages, err
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// atomContent carries the `type="html"` attribute the Atom spec requires for rendered HTML content; without it
+// conformant readers treat the body as plain text and markup shows through literally.
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Content atomContent `xml:"content"`
+}
+
+func feedAtomHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pages, err := feedPages(db, r)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		feed := atomFeed{
+			Xmlns:   "http://www.w3.org/2005/Atom",
+			Id:      baseUrl + "/",
+			Title:   "publish.li",
+			Updated: time.Now().Format(time.RFC3339),
+			Link:    atomLink{Href: baseUrl + "/"},
+		}
+		for _, page := range pages {
+			pageUrl := baseUrl + "/" + page.Name
+
+			var author *atomAuthor
+			if page.Author != "" {
+				author = &atomAuthor{Name: page.Author}
+			}
+
+			feed.Entries = append(feed.Entries, atomEntry{
+				Id:      pageUrl,
+				Title:   page.Title,
+				Link:    atomLink{Href: pageUrl},
+				Updated: page.Updated.Format(time.RFC3339),
+				Author:  author,
+				Content: atomContent{Type: "html", Value: string(page.Html)},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/atom+xml")
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(feed)
+	}
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title string    `xml:"title"`
+	Link  string    `xml:"link"`
+	Items []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Guid        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+func feedRssHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pages, err := feedPages(db, r)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		feed := rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{
+				Title: "publish.li",
+				Link:  baseUrl + "/",
+			},
+		}
+		for _, page := range pages {
+			pageUrl := baseUrl + "/" + page.Name
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:       page.Title,
+				Link:        pageUrl,
+				Guid:        pageUrl,
+				PubDate:     page.Inserted.Format(time.RFC1123Z),
+				Description: string(page.Html),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(feed)
+	}
+}
+
+type jsonFeed struct {
+	Version string         `json:"version"`
+	Title   string         `json:"title"`
+	HomeUrl string         `json:"home_page_url"`
+	FeedUrl string         `json:"feed_url"`
+	Items   []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id            string `json:"id"`
+	Url           string `json:"url"`
+	Title         string `json:"title"`
+	ContentHtml   string `json:"content_html"`
+	DatePublished string `json:"date_published"`
+	DateModified  string `json:"date_modified"`
+}
+
+func feedJsonHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pages, err := feedPages(db, r)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		feed := jsonFeed{
+			Version: "https://jsonfeed.org/version/1.1",
+			Title:   "publish.li",
+			HomeUrl: baseUrl + "/",
+			FeedUrl: baseUrl + "/feed.json",
+		}
+		for _, page := range pages {
+			pageUrl := baseUrl + "/" + page.Name
+			feed.Items = append(feed.Items, jsonFeedItem{
+				Id:            pageUrl,
+				Url:           pageUrl,
+				Title:         page.Title,
+				ContentHtml:   string(page.Html),
+				DatePublished: page.Inserted.Format(time.RFC3339),
+				DateModified:  page.Updated.Format(time.RFC3339),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/feed+json")
+		json.NewEncoder(w).Encode(feed)
+	}
+}
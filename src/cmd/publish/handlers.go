@@ -64,6 +64,7 @@ func apiPut(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 		github := r.FormValue("github")
 		facebook := r.FormValue("facebook")
 		instagram := r.FormValue("instagram")
+		mastodon := r.FormValue("mastodon")
 
 		// validation
 
@@ -105,25 +106,45 @@ func apiPut(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+		mastodonUser, mastodonInstance := "", ""
+		if mastodon != "" {
+			var ok bool
+			mastodonUser, mastodonInstance, ok = splitMastodonHandle(mastodon)
+			if !ok || !isValidMastodonHandle(mastodon) {
+				sendError(w, "Invalid Mastodon Handle. Use the @user@instance.tld form.")
+				return
+			}
+		}
+
+		// pages published while logged in belong to that user; anonymous publishes fall back to the legacy
+		// owner and can be claimed later by entering the page's Id, same as pages that pre-date accounts
+		ownerId := legacyUserId
+		if user, _ := currentUser(db, r); user != nil {
+			ownerId = user.Id
+		}
 
 		// fill in the other fields to save this page
 		now := time.Now()
 		page := Page{
-			Id:        randStr(16),
-			Name:      slug + "-" + randStr(8),
-			Title:     title,
-			Author:    author,
-			Website:   website,
-			Content:   content,
-			Twitter:   twitter,
-			Facebook:  facebook,
-			GitHub:    github,
-			Instagram: instagram,
-			Inserted:  now,
-			Updated:   now,
+			Id:               randStr(16),
+			Name:             slug + "-" + randStr(8),
+			OwnerId:          ownerId,
+			Title:            title,
+			Author:           author,
+			Website:          website,
+			Content:          content,
+			Twitter:          twitter,
+			Facebook:         facebook,
+			GitHub:           github,
+			Instagram:        instagram,
+			Mastodon:         mastodonUser,
+			MastodonInstance: mastodonInstance,
+			Inserted:         now,
+			Updated:          now,
 		}
 
 		// and finally, create the HTML
+		page.Content = rewriteMediaRefs(db, page.OwnerId, page.Content)
 		html := blackfriday.MarkdownCommon([]byte(page.Content))
 		page.Html = template.HTML(html)
 
@@ -133,6 +154,8 @@ func apiPut(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		enqueueCreate(db, page)
+
 		data := struct {
 			Ok      bool              `json:"ok"`
 			Msg     string            `json:"msg"`
@@ -153,7 +176,6 @@ func apiPut(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 
 func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := r.FormValue("id")
 		name := r.FormValue("name")
 		title := r.FormValue("title")
 		content := r.FormValue("content")
@@ -163,8 +185,21 @@ func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 		github := r.FormValue("github")
 		facebook := r.FormValue("facebook")
 		instagram := r.FormValue("instagram")
+		mastodon := r.FormValue("mastodon")
+
+		// a logged-in user can only ever edit their own pages
+		user, errUser := currentUser(db, r)
+		if errUser != nil {
+			log.Printf("Error: %v\n", errUser)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+		if user == nil {
+			sendError(w, "Permission denied.")
+			return
+		}
 
-		// using the page.Name, retrieve this page then check it's Id is correct
+		// using the page.Name, retrieve this page then check it's owned by this user
 		existPage, errGet := storeGetPage(db, name)
 		if errGet != nil {
 			log.Printf("Error: %v\n", errGet)
@@ -177,8 +212,8 @@ func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// check that this page has this Id
-		if existPage.Id != id {
+		// check that this page belongs to this user
+		if existPage.OwnerId != user.Id {
 			sendError(w, "Permission denied.")
 			return
 		}
@@ -223,6 +258,15 @@ func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+		mastodonUser, mastodonInstance := "", ""
+		if mastodon != "" {
+			var ok bool
+			mastodonUser, mastodonInstance, ok = splitMastodonHandle(mastodon)
+			if !ok || !isValidMastodonHandle(mastodon) {
+				sendError(w, "Invalid Mastodon Handle. Use the @user@instance.tld form.")
+				return
+			}
+		}
 
 		// We don't trust what is in the incoming params, but we know `existPage` is fine, so we'll just update a
 		// the fields there to then re-save.
@@ -235,10 +279,13 @@ func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 		existPage.Facebook = facebook
 		existPage.GitHub = github
 		existPage.Instagram = instagram
+		existPage.Mastodon = mastodonUser
+		existPage.MastodonInstance = mastodonInstance
 		existPage.Updated = now
 
 		// and finally, create the HTML
-		html := blackfriday.MarkdownCommon([]byte(content))
+		existPage.Content = rewriteMediaRefs(db, existPage.OwnerId, existPage.Content)
+		html := blackfriday.MarkdownCommon([]byte(existPage.Content))
 		existPage.Html = template.HTML(html)
 
 		errIns := storePutPage(db, *existPage)
@@ -247,6 +294,8 @@ func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		enqueueCreate(db, *existPage)
+
 		data := struct {
 			Ok      bool              `json:"ok"`
 			Msg     string            `json:"msg"`
@@ -345,13 +394,30 @@ func servePage(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 		return
 	}
 
+	// Mastodon and friends fetch the actor document from this same URL, asking for ActivityStreams content
+	// instead of HTML.
+	if wantsActivityJson(r) {
+		serveActor(w, db, page)
+		return
+	}
+
+	// advertise the Webmention endpoint so senders don't have to guess it
+	w.Header().Add("Link", "</webmention>; rel=\"webmention\"")
+
+	mentions, errMentions := storeGetWebmentions(db, page.Name)
+	if errMentions != nil {
+		log.Printf("Error: %v\n", errMentions)
+	}
+
 	// serve the page
 	data := struct {
-		Layout string
-		Page   *Page
+		Layout      string
+		Page        *Page
+		Webmentions []Webmention
 	}{
 		"page",
 		page,
+		mentions,
 	}
 	render(w, "page.html", data)
 }
@@ -372,6 +438,10 @@ func sitemap(w http.ResponseWriter, r *http.Request, baseUrl string, db *bolt.DB
 }
 
 func homeHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	feedAtom := feedAtomHandler(db)
+	feedRss := feedRssHandler(db)
+	feedJson := feedJsonHandler(db)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		log.Printf("path=%s\n", path)
@@ -395,6 +465,15 @@ func homeHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 		} else if path == "/sitemap.txt" {
 			sitemap(w, r, baseUrl, db)
 
+		} else if path == "/feed.xml" {
+			feedAtom(w, r)
+
+		} else if path == "/rss.xml" {
+			feedRss(w, r)
+
+		} else if path == "/feed.json" {
+			feedJson(w, r)
+
 		} else {
 			servePage(w, r, db)
 		}
@@ -0,0 +1,340 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Media uploads are optional: the `/media` handler only does anything when MEDIA_BACKEND is set, following the
+// same "make it optional" pattern as the rest of the optional subsystems in this package.
+
+var mediaBucket = []byte("media")
+
+var mediaBackendName string
+var mediaBaseUrl string
+var mediaLocalDir string
+var mediaMaxBytes int64 = 10 * 1024 * 1024
+
+var mediaS3Bucket string
+var mediaBunnyZone string
+var mediaBunnyAccessKey string
+
+func init() {
+	mediaBackendName = os.Getenv("MEDIA_BACKEND")
+	mediaBaseUrl = os.Getenv("MEDIA_BASE_URL")
+	mediaLocalDir = os.Getenv("MEDIA_LOCAL_DIR")
+	mediaS3Bucket = os.Getenv("MEDIA_S3_BUCKET")
+	mediaBunnyZone = os.Getenv("MEDIA_BUNNY_ZONE")
+	mediaBunnyAccessKey = os.Getenv("MEDIA_BUNNY_ACCESS_KEY")
+}
+
+func mediaEnabled() bool {
+	return mediaBackendName != ""
+}
+
+// mediaEntry is the index record kept for every uploaded object, in the "media" Bolt bucket, so uploads can later
+// be listed or deleted and so apiPut/apiPost/micropubHandler can rewrite markdown image references.
+//
+// OwnerKey identifies whoever authenticated the upload: a local User.Id for dashboard/session uploads, or the
+// IndieAuth `me` URL for Micropub uploads. It's the same key apiPut/apiPost/micropubHandler use as a page's
+// OwnerId, so an upload and the page that ends up referencing it always share one owner.
+type mediaEntry struct {
+	Id          string `json:"id"`
+	Filename    string `json:"filename"`
+	Hash        string `json:"hash"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	OwnerKey    string `json:"ownerKey"`
+	PublicUrl   string `json:"publicUrl"`
+}
+
+// mediaStorageBackend is implemented by each of local/s3/bunny so mediaHandler doesn't need to know which one is
+// in use.
+type mediaStorageBackend interface {
+	put(path string, contentType string, data []byte) (publicUrl string, err error)
+}
+
+func currentMediaBackend() (mediaStorageBackend, error) {
+	switch mediaBackendName {
+	case "local":
+		return localBackend{}, nil
+	case "s3":
+		return s3Backend{bucket: mediaS3Bucket}, nil
+	case "bunny":
+		return bunnyBackend{zone: mediaBunnyZone, accessKey: mediaBunnyAccessKey}, nil
+	default:
+		return nil, fmt.Errorf("media: unknown MEDIA_BACKEND %q", mediaBackendName)
+	}
+}
+
+type localBackend struct{}
+
+func (localBackend) put(path string, contentType string, data []byte) (string, error) {
+	fullPath := filepath.Join(mediaLocalDir, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(fullPath, data, 0644); err != nil {
+		return "", err
+	}
+	return mediaBaseUrl + "/" + path, nil
+}
+
+type s3Backend struct {
+	bucket string
+}
+
+func (b s3Backend) put(path string, contentType string, data []byte) (string, error) {
+	sess, err := newS3Session()
+	if err != nil {
+		return "", err
+	}
+	_, err = s3PutObject(sess, b.bucket, path, contentType, data)
+	if err != nil {
+		return "", err
+	}
+	return mediaBaseUrl + "/" + path, nil
+}
+
+type bunnyBackend struct {
+	zone      string
+	accessKey string
+}
+
+func (b bunnyBackend) put(path string, contentType string, data []byte) (string, error) {
+	url := fmt.Sprintf("https://storage.bunnycdn.com/%s/%s", b.zone, path)
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("AccessKey", b.accessKey)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("media: bunny upload of %s returned %d", path, resp.StatusCode)
+	}
+
+	return mediaBaseUrl + "/" + path, nil
+}
+
+// mediaAuth accepts either an authenticated dashboard session or a Micropub Bearer token, matching the Micropub
+// media-endpoint contract this handler is meant to fulfil, and returns the owner key uploads should be filed
+// under.
+func mediaAuth(db *bolt.DB, r *http.Request) (ownerKey string, ok bool) {
+	if user, _ := currentUser(db, r); user != nil {
+		return user.Id, true
+	}
+	if me, ok := micropubAuth(r); ok {
+		return me, true
+	}
+	return "", false
+}
+
+func mediaHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !mediaEnabled() {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != "POST" {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+
+		ownerKey, ok := mediaAuth(db, r)
+		if !ok {
+			sendError(w, "Permission denied.")
+			return
+		}
+
+		if err := r.ParseMultipartForm(mediaMaxBytes); err != nil {
+			sendError(w, "Could not parse upload")
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			sendError(w, "Provide a file")
+			return
+		}
+		defer file.Close()
+
+		if header.Size > mediaMaxBytes {
+			sendError(w, "File too large")
+			return
+		}
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			sendError(w, "Could not read upload")
+			return
+		}
+
+		contentType := header.Header.Get("Content-Type")
+		if !isAllowedMediaType(contentType) {
+			sendError(w, "Unsupported file type")
+			return
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+
+		ext := filepath.Ext(header.Filename)
+		id := randStr(16)
+		path := id + ext
+
+		backend, err := currentMediaBackend()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		publicUrl, err := backend.put(path, contentType, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		entry := mediaEntry{
+			Id:          id,
+			Filename:    header.Filename,
+			Hash:        hash,
+			Size:        header.Size,
+			ContentType: contentType,
+			OwnerKey:    ownerKey,
+			PublicUrl:   publicUrl,
+		}
+		if err := storePutMedia(db, entry); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", publicUrl)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+var allowedMediaTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func isAllowedMediaType(contentType string) bool {
+	return allowedMediaTypes[contentType]
+}
+
+func storePutMedia(db *bolt.DB, entry mediaEntry) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(mediaBucket)
+		if err != nil {
+			return err
+		}
+		out, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(entry.Id), out)
+	})
+}
+
+func storeDeleteMedia(db *bolt.DB, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mediaBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// mediaEntriesForOwner returns every uploaded object belonging to the given owner key (a local User.Id or an
+// IndieAuth `me` URL), used to rewrite markdown image references before rendering.
+func mediaEntriesForOwner(db *bolt.DB, ownerKey string) ([]mediaEntry, error) {
+	var entries []mediaEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(mediaBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var entry mediaEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.OwnerKey == ownerKey {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	return entries, err
+}
+
+var markdownImageRef = regexp.MustCompile(`!\[([^\]]*)\]\(([^)]+)\)`)
+
+// rewriteMediaRefs replaces relative `![alt](filename)` references in content with the public URL of a matching
+// upload owned by the same key (local User.Id or Micropub `me`) as the page being saved, so it works whether the
+// page is published/edited via the dashboard or created via Micropub.
+func rewriteMediaRefs(db *bolt.DB, ownerKey string, content string) string {
+	entries, err := mediaEntriesForOwner(db, ownerKey)
+	if err != nil || len(entries) == 0 {
+		return content
+	}
+
+	byFilename := make(map[string]string)
+	for _, entry := range entries {
+		byFilename[entry.Filename] = entry.PublicUrl
+	}
+
+	return markdownImageRef.ReplaceAllStringFunc(content, func(match string) string {
+		groups := markdownImageRef.FindStringSubmatch(match)
+		alt, ref := groups[1], groups[2]
+		if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+			return match
+		}
+		if url, ok := byFilename[ref]; ok {
+			return fmt.Sprintf("![%s](%s)", alt, url)
+		}
+		return match
+	})
+}
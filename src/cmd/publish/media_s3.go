@@ -0,0 +1,45 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// newS3Session picks up credentials and region the usual AWS SDK way (env vars, shared config, instance role),
+// so there's nothing publish.li-specific to configure beyond MEDIA_S3_BUCKET.
+func newS3Session() (*session.Session, error) {
+	return session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+}
+
+func s3PutObject(sess *session.Session, bucket, path, contentType string, data []byte) (*s3.PutObjectOutput, error) {
+	svc := s3.New(sess)
+	return svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(path),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+		ACL:         aws.String("public-read"),
+	})
+}
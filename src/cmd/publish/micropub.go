@@ -0,0 +1,263 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Machiel/slugify"
+	"github.com/boltdb/bolt"
+	"github.com/russross/blackfriday"
+)
+
+// Micropub (https://www.w3.org/TR/micropub/) lets IndieWeb clients such as Quill, Indigenous and Micro.blog post to
+// publish.li on the user's behalf. It is a separate subsystem from the `/api` endpoint above, but reuses the same
+// Page type, storePutPage() and the blackfriday render step.
+
+var micropubTokenEndpoint string
+var micropubMediaEndpoint string
+var micropubAllowedMe map[string]bool
+
+func init() {
+	micropubTokenEndpoint = os.Getenv("MICROPUB_TOKEN_ENDPOINT")
+	micropubMediaEndpoint = os.Getenv("MICROPUB_MEDIA_ENDPOINT")
+
+	micropubAllowedMe = make(map[string]bool)
+	for _, me := range strings.Split(os.Getenv("MICROPUB_ALLOWED_ME"), ",") {
+		me = strings.TrimSpace(me)
+		if me != "" {
+			micropubAllowedMe[me] = true
+		}
+	}
+}
+
+// micropubError writes a Micropub-spec error response : https://www.w3.org/TR/micropub/#error-response
+func micropubError(w http.ResponseWriter, status int, error string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{error, description})
+}
+
+// micropubAuth verifies the Bearer token against the configured IndieAuth token endpoint and checks that the
+// returned `me` is in the whitelist. It returns the verified `me` URL on success.
+func micropubAuth(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == "" || token == auth {
+		token = r.FormValue("access_token")
+	}
+	if token == "" {
+		return "", false
+	}
+
+	req, err := http.NewRequest("GET", micropubTokenEndpoint, nil)
+	if err != nil {
+		return "", false
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false
+	}
+
+	var body struct {
+		Me string `json:"me"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", false
+	}
+
+	if body.Me == "" || !micropubAllowedMe[body.Me] {
+		return "", false
+	}
+
+	return body.Me, true
+}
+
+// micropubProperties is the `properties` object of an h-entry, shared by both the form-encoded and JSON request
+// bodies once parsed.
+type micropubProperties struct {
+	Name      []string `json:"name"`
+	Content   []string `json:"content"`
+	Category  []string `json:"category"`
+	LikeOf    []string `json:"like-of"`
+	InReplyTo []string `json:"in-reply-to"`
+}
+
+// micropubParse reads an incoming create request, in either `application/x-www-form-urlencoded` or
+// `application/json` form, and returns the h-entry properties.
+func micropubParse(r *http.Request) (*micropubProperties, bool) {
+	contentType := r.Header.Get("Content-Type")
+
+	if strings.HasPrefix(contentType, "application/json") {
+		var body struct {
+			Type       []string           `json:"type"`
+			Properties micropubProperties `json:"properties"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, false
+		}
+		if len(body.Type) == 0 || body.Type[0] != "h-entry" {
+			return nil, false
+		}
+		return &body.Properties, true
+	}
+
+	if r.FormValue("h") != "entry" {
+		return nil, false
+	}
+
+	props := &micropubProperties{
+		Name:      []string{r.FormValue("name")},
+		Content:   []string{r.FormValue("content")},
+		Category:  r.Form["category[]"],
+		LikeOf:    []string{r.FormValue("like-of")},
+		InReplyTo: []string{r.FormValue("in-reply-to")},
+	}
+	return props, true
+}
+
+func first(ss []string) string {
+	if len(ss) == 0 {
+		return ""
+	}
+	return ss[0]
+}
+
+// micropubSource maps a Page onto the Micropub `properties` shape used by `q=source`.
+func micropubSource(page *Page) map[string][]string {
+	return map[string][]string{
+		"name":     {page.Title},
+		"content":  {page.Content},
+		"category": page.Tags,
+	}
+}
+
+func micropubHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			switch r.FormValue("q") {
+			case "config":
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(struct {
+					MediaEndpoint string   `json:"media-endpoint"`
+					SyndicateTo   []string `json:"syndicate-to"`
+				}{micropubMediaEndpoint, []string{}})
+				return
+
+			case "source":
+				url := r.FormValue("url")
+				name := strings.TrimPrefix(url, baseUrl+"/")
+				page, errGet := storeGetPage(db, name)
+				if errGet != nil {
+					log.Printf("Error: %v\n", errGet)
+					micropubError(w, http.StatusInternalServerError, "internal_error", "Could not look up page")
+					return
+				}
+				if page == nil {
+					micropubError(w, http.StatusNotFound, "not_found", "No such page")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(struct {
+					Type       []string            `json:"type"`
+					Properties map[string][]string `json:"properties"`
+				}{[]string{"h-entry"}, micropubSource(page)})
+				return
+			}
+
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Unknown query")
+			return
+		}
+
+		if r.Method != "POST" {
+			micropubError(w, http.StatusNotFound, "not_found", "")
+			return
+		}
+
+		me, ok := micropubAuth(r)
+		if !ok {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing access token")
+			return
+		}
+		log.Printf("micropub: post from me=%s\n", me)
+
+		props, ok := micropubParse(r)
+		if !ok {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Could not parse h-entry")
+			return
+		}
+
+		title := first(props.Name)
+		content := first(props.Content)
+		if title == "" {
+			title = content
+		}
+
+		slug := slugify.Slugify(title)
+		if slug == "" {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Provide a name or content")
+			return
+		}
+
+		now := time.Now()
+		page := Page{
+			Id:       randStr(16),
+			Name:     slug + "-" + randStr(8),
+			OwnerId:  me,
+			Title:    title,
+			Content:  content,
+			Tags:     props.Category,
+			Inserted: now,
+			Updated:  now,
+		}
+
+		// same post-publish steps apiPut runs: resolve any uploaded media this author referenced, then render
+		page.Content = rewriteMediaRefs(db, page.OwnerId, page.Content)
+		html := blackfriday.MarkdownCommon([]byte(page.Content))
+		page.Html = template.HTML(html)
+
+		if errIns := storePutPage(db, page); errIns != nil {
+			micropubError(w, http.StatusInternalServerError, "internal_error", errIns.Error())
+			return
+		}
+
+		enqueueCreate(db, page)
+
+		w.Header().Set("Location", baseUrl+"/"+page.Name)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
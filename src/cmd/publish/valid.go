@@ -3,10 +3,13 @@ package main
 import "strings"
 
 var chars = "abcdefghijklmnopqrstuvwxyz"
+var digits = "0123456789"
 var twitterChars = chars + "_"
 var facebookChars = chars + "."
 var githubChars = chars + "-"
 var instagramChars = chars
+var mastodonChars = chars + digits + "_."
+var mastodonDomainChars = chars + digits + "-"
 
 func isValidTwitterHandle(handle string) bool {
 	return strings.Trim(strings.ToLower(handle), twitterChars) == ""
@@ -23,3 +26,56 @@ func isValidGitHubHandle(handle string) bool {
 func isValidInstagramHandle(handle string) bool {
 	return strings.Trim(strings.ToLower(handle), instagramChars) == ""
 }
+
+// isValidMastodonHandle accepts the `@user@instance.tld` form used across the fediverse (Mastodon, WriteFreely,
+// etc), splitting on the second `@` and validating each half in turn.
+func isValidMastodonHandle(handle string) bool {
+	user, instance, ok := splitMastodonHandle(handle)
+	if !ok {
+		return false
+	}
+	return isValidMastodonUser(user) && isValidMastodonInstance(instance)
+}
+
+// splitMastodonHandle splits `@user@instance.tld` (the leading `@` is optional) into its user and instance parts.
+func splitMastodonHandle(handle string) (user string, instance string, ok bool) {
+	handle = strings.TrimPrefix(handle, "@")
+	parts := strings.SplitN(handle, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func isValidMastodonUser(user string) bool {
+	return strings.Trim(strings.ToLower(user), mastodonChars) == ""
+}
+
+// isValidMastodonInstance validates a domain against RFC-1035 label rules: each dot-separated label is made of
+// letters, digits and hyphens, is at most 63 chars long, and doesn't start or end with a hyphen. The whole domain
+// must be no more than 253 chars.
+func isValidMastodonInstance(instance string) bool {
+	instance = strings.ToLower(instance)
+	if instance == "" || len(instance) > 253 {
+		return false
+	}
+
+	labels := strings.Split(instance, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		if strings.Trim(label, mastodonDomainChars) != "" {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidMastodonHandle(t *testing.T) {
+	cases := []struct {
+		handle string
+		want   bool
+	}{
+		{"@user@mastodon.social", true},
+		{"user@mastodon.social", true},
+		{"@user.name_2@writefreely.example.com", true},
+		{"@user@", false},
+		{"@@mastodon.social", false},
+		{"@user@-mastodon.social", false},
+		{"@user@mastodon.social-", false},
+		{"@user@mastodon", false},
+		{"@user", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if got := isValidMastodonHandle(c.handle); got != c.want {
+			t.Errorf("isValidMastodonHandle(%q) = %v, want %v", c.handle, got, c.want)
+		}
+	}
+}
+
+func TestIsValidMastodonInstance(t *testing.T) {
+	cases := []struct {
+		instance string
+		want     bool
+	}{
+		{"mastodon.social", true},
+		{"sub.example.co.uk", true},
+		{"", false},
+		{"nodots", false},
+		{"-leading.tld", false},
+		{"trailing-.tld", false},
+		{"has_underscore.tld", false},
+		{strings.Join([]string{
+			strings.Repeat("a", 60), strings.Repeat("b", 60), strings.Repeat("c", 60),
+			strings.Repeat("d", 60), strings.Repeat("e", 60), "tld",
+		}, "."), false}, // over the 253-char total limit
+		{strings.Repeat("a", 64) + ".tld", false}, // over the 63-char label limit
+	}
+
+	for _, c := range cases {
+		if got := isValidMastodonInstance(c.instance); got != c.want {
+			t.Errorf("isValidMastodonInstance(%q) = %v, want %v", c.instance, got, c.want)
+		}
+	}
+}
+
+func TestSplitMastodonHandle(t *testing.T) {
+	user, instance, ok := splitMastodonHandle("@user@mastodon.social")
+	if !ok || user != "user" || instance != "mastodon.social" {
+		t.Errorf("splitMastodonHandle = (%q, %q, %v), want (\"user\", \"mastodon.social\", true)", user, instance, ok)
+	}
+
+	if _, _, ok := splitMastodonHandle("no-at-signs"); ok {
+		t.Errorf("splitMastodonHandle(%q) ok = true, want false", "no-at-signs")
+	}
+}
@@ -0,0 +1,271 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"willnorris.com/go/microformats"
+)
+
+// Webmention (https://www.w3.org/TR/webmention/) lets other sites notify a publish.li page that they've linked to
+// it. publish.li pages are otherwise anonymous targets, so verification, a per-domain rate limit and a blocklist
+// all matter here more than they would on a site with accounts-only commenting.
+
+var webmentionsBucket = []byte("webmentions")
+var webmentionBlocklistBucket = []byte("webmention_blocklist")
+
+type Webmention struct {
+	Source      string    `json:"source"`
+	Target      string    `json:"target"`
+	Type        string    `json:"type"` // "reply", "like" or "repost"
+	AuthorName  string    `json:"authorName"`
+	AuthorUrl   string    `json:"authorUrl"`
+	AuthorPhoto string    `json:"authorPhoto"`
+	Content     string    `json:"content"`
+	Received    time.Time `json:"received"`
+}
+
+var webmentionRateMu sync.Mutex
+var webmentionLastSeen = make(map[string]time.Time)
+var webmentionRateLimit = 10 * time.Second
+
+func webmentionRateLimited(domain string) bool {
+	webmentionRateMu.Lock()
+	defer webmentionRateMu.Unlock()
+
+	last, ok := webmentionLastSeen[domain]
+	now := time.Now()
+	webmentionLastSeen[domain] = now
+	return ok && now.Sub(last) < webmentionRateLimit
+}
+
+func isBlockedDomain(db *bolt.DB, domain string) (bool, error) {
+	blocked := false
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webmentionBlocklistBucket)
+		if b == nil {
+			return nil
+		}
+		blocked = b.Get([]byte(domain)) != nil
+		return nil
+	})
+	return blocked, err
+}
+
+func webmentionHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+
+		source := r.FormValue("source")
+		target := r.FormValue("target")
+		if source == "" || target == "" {
+			sendError(w, "Provide both source and target")
+			return
+		}
+
+		sourceUrl, err := url.ParseRequestURI(source)
+		if err != nil {
+			sendError(w, "Invalid source URL")
+			return
+		}
+
+		if blocked, err := isBlockedDomain(db, sourceUrl.Host); err != nil {
+			log.Printf("Error: %v\n", err)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		} else if blocked {
+			sendError(w, "Source domain is blocked.")
+			return
+		}
+
+		if webmentionRateLimited(sourceUrl.Host) {
+			sendError(w, "Too many webmentions from this domain, try again shortly.")
+			return
+		}
+
+		name := strings.TrimPrefix(target, baseUrl+"/")
+		page, errGet := storeGetPage(db, name)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+		if page == nil {
+			sendError(w, "Target does not match a page on this site.")
+			return
+		}
+
+		go verifyAndStoreWebmention(db, source, target, page.Name)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// verifyAndStoreWebmention fetches the source, confirms it really links to the target, parses its h-entry and
+// persists the mention. It runs asynchronously so the sender doesn't have to wait on us fetching their page.
+func verifyAndStoreWebmention(db *bolt.DB, source, target, pageName string) {
+	resp, err := http.Get(source)
+	if err != nil {
+		log.Printf("webmention: could not fetch source %s: %v\n", source, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	sourceUrl, err := url.Parse(source)
+	if err != nil {
+		return
+	}
+
+	data := microformats.Parse(resp.Body, sourceUrl)
+
+	entry := findHEntry(data.Items)
+	if entry == nil || !linksTo(entry, target) {
+		log.Printf("webmention: %s does not link to %s, ignoring\n", source, target)
+		return
+	}
+
+	mention := Webmention{
+		Source:      source,
+		Target:      target,
+		Type:        mentionType(entry, target),
+		AuthorName:  mfProp(entry, "author", "name"),
+		AuthorUrl:   mfProp(entry, "author", "url"),
+		AuthorPhoto: mfProp(entry, "author", "photo"),
+		Content:     mfValue(entry, "content"),
+		Received:    time.Now(),
+	}
+
+	if err := storePutWebmention(db, pageName, mention); err != nil {
+		log.Printf("webmention: could not store mention for %s: %v\n", pageName, err)
+	}
+}
+
+func findHEntry(items []*microformats.Microformat) *microformats.Microformat {
+	for _, item := range items {
+		for _, t := range item.Type {
+			if t == "h-entry" {
+				return item
+			}
+		}
+		if found := findHEntry(item.Children); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func linksTo(entry *microformats.Microformat, target string) bool {
+	for _, prop := range []string{"in-reply-to", "like-of", "repost-of"} {
+		for _, v := range entry.Properties[prop] {
+			if s, ok := v.(string); ok && s == target {
+				return true
+			}
+		}
+	}
+	return strings.Contains(mfValue(entry, "content"), target)
+}
+
+func mentionType(entry *microformats.Microformat, target string) string {
+	for _, v := range entry.Properties["like-of"] {
+		if s, ok := v.(string); ok && s == target {
+			return "like"
+		}
+	}
+	for _, v := range entry.Properties["repost-of"] {
+		if s, ok := v.(string); ok && s == target {
+			return "repost"
+		}
+	}
+	return "reply"
+}
+
+// mfValue reads a property value off an h-entry. Most properties (u-*, p-name, ...) parse as a plain string, but
+// e-content parses as map[string]string{"value": ..., "html": ...} since it carries both an HTML and a plain-text
+// rendering, so that shape has to be handled here too or e-content always comes back empty.
+func mfValue(entry *microformats.Microformat, prop string) string {
+	for _, v := range entry.Properties[prop] {
+		if s, ok := v.(string); ok {
+			return s
+		}
+		if m, ok := v.(map[string]string); ok {
+			return m["value"]
+		}
+	}
+	return ""
+}
+
+func mfProp(entry *microformats.Microformat, card, prop string) string {
+	for _, v := range entry.Properties[card] {
+		if sub, ok := v.(*microformats.Microformat); ok {
+			return mfValue(sub, prop)
+		}
+	}
+	return ""
+}
+
+func storePutWebmention(db *bolt.DB, pageName string, mention Webmention) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(webmentionsBucket)
+		if err != nil {
+			return err
+		}
+
+		var mentions []Webmention
+		if v := b.Get([]byte(pageName)); v != nil {
+			if err := json.Unmarshal(v, &mentions); err != nil {
+				return err
+			}
+		}
+		mentions = append(mentions, mention)
+
+		out, err := json.Marshal(mentions)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(pageName), out)
+	})
+}
+
+func storeGetWebmentions(db *bolt.DB, pageName string) ([]Webmention, error) {
+	var mentions []Webmention
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webmentionsBucket)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(pageName))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &mentions)
+	})
+	return mentions, err
+}
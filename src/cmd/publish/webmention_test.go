@@ -0,0 +1,148 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"testing"
+
+	"willnorris.com/go/microformats"
+)
+
+func entryWithProps(props map[string][]interface{}) *microformats.Microformat {
+	return &microformats.Microformat{
+		Type:       []string{"h-entry"},
+		Properties: props,
+	}
+}
+
+func TestLinksTo(t *testing.T) {
+	target := "https://publish.li/hello"
+
+	cases := []struct {
+		name  string
+		entry *microformats.Microformat
+		want  bool
+	}{
+		{
+			name:  "in-reply-to matches",
+			entry: entryWithProps(map[string][]interface{}{"in-reply-to": {target}}),
+			want:  true,
+		},
+		{
+			name:  "like-of matches",
+			entry: entryWithProps(map[string][]interface{}{"like-of": {target}}),
+			want:  true,
+		},
+		{
+			name:  "repost-of matches",
+			entry: entryWithProps(map[string][]interface{}{"repost-of": {target}}),
+			want:  true,
+		},
+		{
+			name:  "content mentions the target",
+			entry: entryWithProps(map[string][]interface{}{"content": {"great post, see " + target}}),
+			want:  true,
+		},
+		{
+			name: "map-shaped e-content (value/html) mentions the target",
+			entry: entryWithProps(map[string][]interface{}{
+				"content": {map[string]string{"value": "great post, see " + target, "html": "great post, see <a>" + target + "</a>"}},
+			}),
+			want: true,
+		},
+		{
+			name:  "no relation to the target",
+			entry: entryWithProps(map[string][]interface{}{"content": {"unrelated"}, "in-reply-to": {"https://example.com/other"}}),
+			want:  false,
+		},
+	}
+
+	for _, c := range cases {
+		if got := linksTo(c.entry, target); got != c.want {
+			t.Errorf("%s: linksTo() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMentionType(t *testing.T) {
+	target := "https://publish.li/hello"
+
+	cases := []struct {
+		name  string
+		entry *microformats.Microformat
+		want  string
+	}{
+		{"like-of", entryWithProps(map[string][]interface{}{"like-of": {target}}), "like"},
+		{"repost-of", entryWithProps(map[string][]interface{}{"repost-of": {target}}), "repost"},
+		{"plain reply", entryWithProps(map[string][]interface{}{"in-reply-to": {target}}), "reply"},
+		{"like-of for a different target falls back to reply", entryWithProps(map[string][]interface{}{"like-of": {"https://example.com/other"}}), "reply"},
+	}
+
+	for _, c := range cases {
+		if got := mentionType(c.entry, target); got != c.want {
+			t.Errorf("%s: mentionType() = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMfValue(t *testing.T) {
+	entry := entryWithProps(map[string][]interface{}{
+		"content":   {"hello world"},
+		"e-content": {map[string]string{"value": "hello e-content", "html": "hello <b>e-content</b>"}},
+		"empty":     {},
+		"nonstr":    {42},
+	})
+
+	if got := mfValue(entry, "content"); got != "hello world" {
+		t.Errorf("mfValue(content) = %q, want %q", got, "hello world")
+	}
+	if got := mfValue(entry, "e-content"); got != "hello e-content" {
+		t.Errorf("mfValue(e-content) = %q, want %q (map-shaped e-content should read the value key)", got, "hello e-content")
+	}
+	if got := mfValue(entry, "missing"); got != "" {
+		t.Errorf("mfValue(missing) = %q, want %q", got, "")
+	}
+	if got := mfValue(entry, "nonstr"); got != "" {
+		t.Errorf("mfValue(nonstr) = %q, want %q (non-string, non-map values are skipped)", got, "")
+	}
+}
+
+func TestMfProp(t *testing.T) {
+	author := entryWithProps(map[string][]interface{}{
+		"name": {"Jane Doe"},
+		"url":  {"https://example.com/jane"},
+	})
+	entry := entryWithProps(map[string][]interface{}{
+		"author": {author},
+	})
+
+	if got := mfProp(entry, "author", "name"); got != "Jane Doe" {
+		t.Errorf("mfProp(author, name) = %q, want %q", got, "Jane Doe")
+	}
+	if got := mfProp(entry, "author", "url"); got != "https://example.com/jane" {
+		t.Errorf("mfProp(author, url) = %q, want %q", got, "https://example.com/jane")
+	}
+	if got := mfProp(entry, "author", "photo"); got != "" {
+		t.Errorf("mfProp(author, photo) = %q, want %q", got, "")
+	}
+	if got := mfProp(entryWithProps(nil), "author", "name"); got != "" {
+		t.Errorf("mfProp() on an entry with no author = %q, want %q", got, "")
+	}
+}